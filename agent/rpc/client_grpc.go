@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -34,9 +35,33 @@ import (
 // set grpc version on compile time to compare against server version response
 const ClientGrpcVersion int32 = proto.Version
 
+// logBatchInterval and logBatchSize bound how long a log entry can sit in
+// the client-side buffer before LogStream flushes it to the server.
+const (
+	logBatchInterval = 250 * time.Millisecond
+	logBatchSize     = 50
+)
+
+// closeFlushTimeout bounds how long Close() waits for a final flush of any
+// buffered log lines before giving up and tearing the connection down
+// anyway.
+const closeFlushTimeout = 5 * time.Second
+
 type client struct {
 	client proto.WoodpeckerClient
 	conn   *grpc.ClientConn
+
+	capMu        sync.Mutex
+	capStreaming *bool // cached result of the Version() capability check
+
+	nextMu     sync.Mutex
+	nextStream proto.Woodpecker_NextStreamClient
+
+	logMu     sync.Mutex
+	logQueue  []*proto.LogEntry
+	logTimer  *time.Timer
+	logCtx    context.Context
+	logCancel context.CancelFunc
 }
 
 // NewGrpcClient returns a new grpc Client.
@@ -44,13 +69,79 @@ func NewGrpcClient(conn *grpc.ClientConn) rpc.Peer {
 	client := new(client)
 	client.client = proto.NewWoodpeckerClient(conn)
 	client.conn = conn
+	client.logCtx, client.logCancel = context.WithCancel(context.Background())
 	return client
 }
 
 func (c *client) Close() error {
+	c.logMu.Lock()
+	if c.logTimer != nil {
+		c.logTimer.Stop()
+		c.logTimer = nil
+	}
+	c.logMu.Unlock()
+
+	// best-effort: give whatever didn't reach logBatchSize yet a bounded
+	// window to go out before the stream it would travel on is torn down,
+	// instead of silently dropping it.
+	flushCtx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+	if err := c.flushLogStream(flushCtx); err != nil {
+		log.Error().Err(err).Msg("grpc error: could not flush log batch on close")
+	}
+
+	c.logCancel()
+
 	return c.conn.Close()
 }
 
+// Cancelled returns a channel of workflow IDs the server wants this agent
+// to abort, e.g. because a user cancelled the pipeline in the UI or the
+// queue evicted a task that was already dispatched. It reconnects the
+// underlying stream with backoff if the connection drops, and closes the
+// channel once ctx is done.
+func (c *client) Cancelled(ctx context.Context) <-chan string {
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+		retry := c.newBackOff()
+
+		for {
+			stream, err := c.client.Cancel(ctx, &proto.Empty{})
+			if err != nil {
+				log.Error().Err(err).Msgf("grpc error: cancel(): code: %v", status.Code(err))
+				select {
+				case <-time.After(retry.NextBackOff()):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			retry = c.newBackOff()
+
+			for {
+				res, err := stream.Recv()
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Error().Err(err).Msg("grpc error: cancel stream closed, reconnecting")
+					break
+				}
+
+				select {
+				case ch <- res.GetWorkflowId():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
 func (c *client) newBackOff() backoff.BackOff {
 	b := backoff.NewExponentialBackOff()
 	b.MaxInterval = 10 * time.Second
@@ -64,14 +155,88 @@ func (c *client) Version(ctx context.Context) (*rpc.Version, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	c.capMu.Lock()
+	streaming := res.GetCapabilities()&proto.CapabilityStreaming != 0
+	c.capStreaming = &streaming
+	c.capMu.Unlock()
+
 	return &rpc.Version{
 		GrpcVersion:   res.GrpcVersion,
 		ServerVersion: res.ServerVersion,
 	}, nil
 }
 
+// supportsStreaming reports whether the server has advertised the
+// streaming Next/Log capability, probing Version() once if needed.
+func (c *client) supportsStreaming(ctx context.Context) bool {
+	c.capMu.Lock()
+	cached := c.capStreaming
+	c.capMu.Unlock()
+	if cached != nil {
+		return *cached
+	}
+	if _, err := c.Version(ctx); err != nil {
+		return false
+	}
+	c.capMu.Lock()
+	defer c.capMu.Unlock()
+	return c.capStreaming != nil && *c.capStreaming
+}
+
 // Next returns the next workflow in the queue.
 func (c *client) Next(ctx context.Context, f rpc.Filter) (*rpc.Workflow, error) {
+	if c.supportsStreaming(ctx) {
+		return c.nextFromStream(ctx, f)
+	}
+	return c.nextUnary(ctx, f)
+}
+
+// nextFromStream pulls the next workflow off the long-lived push stream the
+// server uses to hand out schedulable workflows, opening it on first use.
+func (c *client) nextFromStream(ctx context.Context, f rpc.Filter) (*rpc.Workflow, error) {
+	c.nextMu.Lock()
+	defer c.nextMu.Unlock()
+
+	if c.nextStream == nil {
+		stream, err := c.client.NextStream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req := new(proto.NextRequest)
+		req.Filter = new(proto.Filter)
+		req.Filter.Labels = f.Labels
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		c.nextStream = stream
+	}
+
+	res, err := c.nextStream.Recv()
+	if err != nil {
+		c.nextStream = nil // force a reconnect on the next call
+		if status.Code(err) == codes.Unimplemented {
+			// server advertised streaming but doesn't actually support it; fall back.
+			c.capMu.Lock()
+			c.capStreaming = new(bool)
+			c.capMu.Unlock()
+			return c.nextUnary(ctx, f)
+		}
+		return nil, err
+	}
+
+	// ack that we're ready to receive the next push once this one is handled.
+	if err := c.nextStream.Send(&proto.NextRequest{Filter: &proto.Filter{Labels: f.Labels}}); err != nil {
+		c.nextStream = nil
+		return nil, err
+	}
+
+	return workflowFromProto(res.GetWorkflow())
+}
+
+// nextUnary is the original poll-and-backoff implementation, kept for
+// servers that have not advertised the streaming capability.
+func (c *client) nextUnary(ctx context.Context, f rpc.Filter) (*rpc.Workflow, error) {
 	var res *proto.NextResponse
 	var err error
 	retry := c.newBackOff()
@@ -111,15 +276,19 @@ func (c *client) Next(ctx context.Context, f rpc.Filter) (*rpc.Workflow, error)
 		}
 	}
 
-	if res.GetWorkflow() == nil {
+	return workflowFromProto(res.GetWorkflow())
+}
+
+func workflowFromProto(pw *proto.Workflow) (*rpc.Workflow, error) {
+	if pw == nil {
 		return nil, nil
 	}
 
 	w := new(rpc.Workflow)
-	w.ID = res.GetWorkflow().GetId()
-	w.Timeout = res.GetWorkflow().GetTimeout()
+	w.ID = pw.GetId()
+	w.Timeout = pw.GetTimeout()
 	w.Config = new(backend.Config)
-	if err := json.Unmarshal(res.GetWorkflow().GetPayload(), w.Config); err != nil {
+	if err := json.Unmarshal(pw.GetPayload(), w.Config); err != nil {
 		log.Error().Err(err).Msgf("could not unmarshal workflow config of '%s'", w.ID)
 	}
 	return w, nil
@@ -318,14 +487,20 @@ func (c *client) Update(ctx context.Context, id string, state rpc.State) (err er
 
 // Log writes the workflow log entry.
 func (c *client) Log(ctx context.Context, logEntry *rpc.LogEntry) (err error) {
+	entry := new(proto.LogEntry)
+	entry.StepUuid = logEntry.StepUUID
+	entry.Data = logEntry.Data
+	entry.Line = int32(logEntry.Line)
+	entry.Time = logEntry.Time
+	entry.Type = int32(logEntry.Type)
+
+	if c.supportsStreaming(ctx) {
+		return c.queueLogEntry(ctx, entry)
+	}
+
 	retry := c.newBackOff()
 	req := new(proto.LogRequest)
-	req.LogEntry = new(proto.LogEntry)
-	req.LogEntry.StepUuid = logEntry.StepUUID
-	req.LogEntry.Data = logEntry.Data
-	req.LogEntry.Line = int32(logEntry.Line)
-	req.LogEntry.Time = logEntry.Time
-	req.LogEntry.Type = int32(logEntry.Type)
+	req.LogEntry = entry
 	for {
 		_, err = c.client.Log(ctx, req)
 		if err == nil {
@@ -355,6 +530,110 @@ func (c *client) Log(ctx context.Context, logEntry *rpc.LogEntry) (err error) {
 	return nil
 }
 
+// queueLogEntry buffers a log entry and flushes the batch to the server's
+// client-streaming LogStream once it reaches logBatchSize or has waited
+// logBatchInterval, whichever comes first. At most one logBatchInterval
+// timer is ever outstanding, so a steady trickle of entries can't pile up
+// a timer per call.
+func (c *client) queueLogEntry(ctx context.Context, entry *proto.LogEntry) error {
+	c.logMu.Lock()
+	c.logQueue = append(c.logQueue, entry)
+	shouldFlush := len(c.logQueue) >= logBatchSize
+	if shouldFlush && c.logTimer != nil {
+		c.logTimer.Stop()
+		c.logTimer = nil
+	}
+	if !shouldFlush && c.logTimer == nil {
+		c.logTimer = time.AfterFunc(logBatchInterval, c.flushLogStreamAsync)
+	}
+	c.logMu.Unlock()
+
+	if shouldFlush {
+		return c.flushLogStream(ctx)
+	}
+	return nil
+}
+
+// flushLogStreamAsync runs the batch-interval flush. It uses c.logCtx
+// rather than context.Background() so it stops retrying once Close() has
+// torn the client down, instead of flushing indefinitely after shutdown.
+func (c *client) flushLogStreamAsync() {
+	c.logMu.Lock()
+	c.logTimer = nil
+	c.logMu.Unlock()
+
+	if err := c.flushLogStream(c.logCtx); err != nil && c.logCtx.Err() == nil {
+		log.Error().Err(err).Msg("grpc error: could not flush log batch")
+	}
+}
+
+// flushLogStream sends the buffered batch, retrying on the same non-fatal
+// codes the unary Log path retries on. On a fatal error or ctx cancellation
+// the batch is put back at the front of the queue rather than dropped, so a
+// later flush can still deliver it.
+func (c *client) flushLogStream(ctx context.Context) error {
+	c.logMu.Lock()
+	batch := c.logQueue
+	c.logQueue = nil
+	c.logMu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	retry := c.newBackOff()
+	for {
+		err := c.sendLogBatch(ctx, batch)
+		if err == nil {
+			return nil
+		}
+
+		log.Error().Err(err).Msgf("grpc error: log stream(): code: %v", status.Code(err))
+
+		switch status.Code(err) {
+		case
+			codes.Aborted,
+			codes.DataLoss,
+			codes.DeadlineExceeded,
+			codes.Internal,
+			codes.Unavailable:
+			// non-fatal errors
+		default:
+			c.requeueLogBatch(batch)
+			return err
+		}
+
+		select {
+		case <-time.After(retry.NextBackOff()):
+		case <-ctx.Done():
+			c.requeueLogBatch(batch)
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *client) sendLogBatch(ctx context.Context, batch []*proto.LogEntry) error {
+	stream, err := c.client.LogStream(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range batch {
+		if err := stream.Send(&proto.LogRequest{LogEntry: entry}); err != nil {
+			return err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// requeueLogBatch puts a batch that failed to send back at the front of the
+// queue so the next flush attempt still delivers it.
+func (c *client) requeueLogBatch(batch []*proto.LogEntry) {
+	c.logMu.Lock()
+	c.logQueue = append(batch, c.logQueue...)
+	c.logMu.Unlock()
+}
+
 func (c *client) RegisterAgent(ctx context.Context, platform, backend, version string, capacity int) (int64, error) {
 	req := new(proto.RegisterAgentRequest)
 	req.Platform = platform
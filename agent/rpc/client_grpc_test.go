@@ -0,0 +1,183 @@
+// Copyright 2023 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.woodpecker-ci.org/woodpecker/v2/pipeline/rpc/proto"
+)
+
+// fakeLogStreamClient is a minimal proto.Woodpecker_LogStreamClient double:
+// embedding the nil grpc.ClientStream lets it satisfy the interface without
+// implementing the methods these tests never exercise.
+type fakeLogStreamClient struct {
+	grpc.ClientStream
+
+	mu       sync.Mutex
+	sent     []*proto.LogEntry
+	sendErr  error
+	closeErr error
+}
+
+func (f *fakeLogStreamClient) Send(req *proto.LogRequest) error {
+	if f.sendErr != nil {
+		return f.sendErr
+	}
+	f.mu.Lock()
+	f.sent = append(f.sent, req.LogEntry)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeLogStreamClient) CloseAndRecv() (*proto.LogResponse, error) {
+	return &proto.LogResponse{}, f.closeErr
+}
+
+// fakeWoodpeckerClient is a minimal proto.WoodpeckerClient double: embedding
+// the nil interface covers every method these tests don't care about.
+type fakeWoodpeckerClient struct {
+	proto.WoodpeckerClient
+
+	mu            sync.Mutex
+	logStreamErr  error
+	logStreams    []*fakeLogStreamClient
+	logStreamOpen int
+}
+
+func (f *fakeWoodpeckerClient) LogStream(_ context.Context, _ ...grpc.CallOption) (proto.Woodpecker_LogStreamClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logStreamOpen++
+	if f.logStreamErr != nil {
+		return nil, f.logStreamErr
+	}
+	stream := &fakeLogStreamClient{}
+	f.logStreams = append(f.logStreams, stream)
+	return stream, nil
+}
+
+func newTestClient(fake *fakeWoodpeckerClient) *client {
+	c := &client{client: fake}
+	c.logCtx, c.logCancel = context.WithCancel(context.Background())
+	return c
+}
+
+func logEntry(line int32) *proto.LogEntry {
+	return &proto.LogEntry{Line: line}
+}
+
+// TestQueueLogEntryFlushesOnBatchSize asserts that queueLogEntry sends the
+// batch as soon as it reaches logBatchSize, without waiting for the timer.
+func TestQueueLogEntryFlushesOnBatchSize(t *testing.T) {
+	fake := &fakeWoodpeckerClient{}
+	c := newTestClient(fake)
+
+	for i := 0; i < logBatchSize-1; i++ {
+		require.NoError(t, c.queueLogEntry(context.Background(), logEntry(int32(i))))
+	}
+	assert.Equal(t, 0, fake.logStreamOpen, "batch shouldn't flush before it reaches logBatchSize")
+
+	require.NoError(t, c.queueLogEntry(context.Background(), logEntry(logBatchSize-1)))
+
+	assert.Equal(t, 1, fake.logStreamOpen)
+	assert.Len(t, fake.logStreams[0].sent, logBatchSize)
+	assert.Empty(t, c.logQueue, "flushed entries should be cleared from the buffer")
+}
+
+// TestQueueLogEntryFlushesOnTimer asserts that a batch under logBatchSize
+// still goes out once logBatchInterval elapses.
+func TestQueueLogEntryFlushesOnTimer(t *testing.T) {
+	fake := &fakeWoodpeckerClient{}
+	c := newTestClient(fake)
+
+	require.NoError(t, c.queueLogEntry(context.Background(), logEntry(0)))
+	assert.Equal(t, 0, fake.logStreamOpen, "batch shouldn't flush before the timer fires")
+
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.logStreamOpen == 1
+	}, time.Second, 5*time.Millisecond, "timer should flush the pending entry")
+
+	assert.Len(t, fake.logStreams[0].sent, 1)
+}
+
+// TestFlushLogStreamRequeuesOnFatalError asserts a fatal send error puts the
+// batch back at the front of the queue instead of dropping it.
+func TestFlushLogStreamRequeuesOnFatalError(t *testing.T) {
+	fake := &fakeWoodpeckerClient{}
+	c := newTestClient(fake)
+	c.logQueue = []*proto.LogEntry{logEntry(0), logEntry(1)}
+
+	fake.logStreamErr = status.Error(codes.PermissionDenied, "no")
+
+	err := c.flushLogStream(context.Background())
+	require.Error(t, err)
+
+	assert.Equal(t, []*proto.LogEntry{logEntry(0), logEntry(1)}, c.logQueue, "the failed batch should be put back, not dropped")
+}
+
+// TestFlushLogStreamRetriesNonFatalThenSucceeds asserts a non-fatal send
+// error is retried rather than immediately requeued.
+func TestFlushLogStreamRetriesNonFatalThenSucceeds(t *testing.T) {
+	fake := &fakeWoodpeckerClient{}
+	c := newTestClient(fake)
+	c.logQueue = []*proto.LogEntry{logEntry(0)}
+
+	attempts := 0
+	fakeClient := &retryingWoodpeckerClient{fakeWoodpeckerClient: fake, attempts: &attempts}
+	c.client = fakeClient
+
+	require.NoError(t, c.flushLogStream(context.Background()))
+	assert.Equal(t, 2, attempts, "should have retried once after the non-fatal error")
+	assert.Empty(t, c.logQueue)
+}
+
+// retryingWoodpeckerClient fails the first LogStream call with a non-fatal
+// code and succeeds on the next, so flushLogStream's retry loop can be
+// exercised without a real server.
+type retryingWoodpeckerClient struct {
+	*fakeWoodpeckerClient
+	attempts *int
+}
+
+func (f *retryingWoodpeckerClient) LogStream(ctx context.Context, opts ...grpc.CallOption) (proto.Woodpecker_LogStreamClient, error) {
+	*f.attempts++
+	if *f.attempts == 1 {
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	return f.fakeWoodpeckerClient.LogStream(ctx, opts...)
+}
+
+// TestRequeueLogBatchKeepsBatchAtFront asserts requeueLogBatch puts its
+// batch ahead of whatever was already queued behind it.
+func TestRequeueLogBatchKeepsBatchAtFront(t *testing.T) {
+	c := newTestClient(&fakeWoodpeckerClient{})
+	c.logQueue = []*proto.LogEntry{logEntry(2)}
+
+	c.requeueLogBatch([]*proto.LogEntry{logEntry(0), logEntry(1)})
+
+	assert.Equal(t, []*proto.LogEntry{logEntry(0), logEntry(1), logEntry(2)}, c.logQueue)
+}
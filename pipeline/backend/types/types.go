@@ -0,0 +1,32 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// Config is the backend-agnostic pipeline execution plan sent to an agent
+// as a workflow's payload.
+type Config struct {
+	Stages []*Stage `json:"stages"`
+}
+
+// Stage is a group of steps that can run in parallel.
+type Stage struct {
+	Steps []*Step `json:"steps"`
+}
+
+// Step is a single container execution within a stage.
+type Step struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
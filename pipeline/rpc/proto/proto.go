@@ -0,0 +1,392 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proto holds the grpc service definition shared by agent and
+// server. It is normally generated from woodpecker.proto by protoc; this
+// file is hand-maintained in its place here.
+package proto
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// Version is the grpc protocol version, bumped whenever the service
+// definition changes in a way that requires both sides to agree on it.
+const Version int32 = 2
+
+// Capability bits advertised by a server in VersionResponse.Capabilities so
+// an older agent can keep using the unary fallbacks.
+const (
+	CapabilityStreaming int32 = 1 << iota
+)
+
+const serviceName = "proto.Woodpecker"
+
+type Empty struct{}
+
+type VersionResponse struct {
+	GrpcVersion   int32
+	ServerVersion string
+	Capabilities  int32
+}
+
+func (m *VersionResponse) GetGrpcVersion() int32 {
+	if m == nil {
+		return 0
+	}
+	return m.GrpcVersion
+}
+
+func (m *VersionResponse) GetCapabilities() int32 {
+	if m == nil {
+		return 0
+	}
+	return m.Capabilities
+}
+
+type Filter struct {
+	Labels map[string]string
+}
+
+type NextRequest struct {
+	Filter *Filter
+}
+
+type Workflow struct {
+	Id      string
+	Timeout int64
+	Payload []byte
+}
+
+func (m *Workflow) GetId() string {
+	if m == nil {
+		return ""
+	}
+	return m.Id
+}
+
+func (m *Workflow) GetTimeout() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.Timeout
+}
+
+func (m *Workflow) GetPayload() []byte {
+	if m == nil {
+		return nil
+	}
+	return m.Payload
+}
+
+type NextResponse struct {
+	Workflow *Workflow
+}
+
+func (m *NextResponse) GetWorkflow() *Workflow {
+	if m == nil {
+		return nil
+	}
+	return m.Workflow
+}
+
+type WaitRequest struct{ Id string }
+type WaitResponse struct{}
+
+type State struct {
+	StepUuid string
+	Error    string
+	ExitCode int32
+	Exited   bool
+	Started  int64
+	Finished int64
+}
+
+type InitRequest struct {
+	Id    string
+	State *State
+}
+type InitResponse struct{}
+
+type DoneRequest struct {
+	Id    string
+	State *State
+}
+type DoneResponse struct{}
+
+type ExtendRequest struct{ Id string }
+type ExtendResponse struct{}
+
+type UpdateRequest struct {
+	Id    string
+	State *State
+}
+type UpdateResponse struct{}
+
+type LogEntry struct {
+	StepUuid string
+	Data     []byte
+	Line     int32
+	Time     int64
+	Type     int32
+}
+
+type LogRequest struct {
+	LogEntry *LogEntry
+}
+type LogResponse struct{}
+
+type CancelResponse struct {
+	WorkflowId string
+}
+
+func (m *CancelResponse) GetWorkflowId() string {
+	if m == nil {
+		return ""
+	}
+	return m.WorkflowId
+}
+
+type RegisterAgentRequest struct {
+	Platform string
+	Backend  string
+	Version  string
+	Capacity int32
+}
+
+type RegisterAgentResponse struct {
+	AgentId int64
+}
+
+func (m *RegisterAgentResponse) GetAgentId() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.AgentId
+}
+
+type ReportHealthRequest struct{ Status string }
+type ReportHealthResponse struct{}
+
+// Woodpecker_NextStreamClient is the agent side of the server-push
+// workflow stream: it sends a Filter/ack and receives workflows as the
+// server schedules them.
+type Woodpecker_NextStreamClient interface {
+	Send(*NextRequest) error
+	Recv() (*NextResponse, error)
+	grpc.ClientStream
+}
+
+// Woodpecker_LogStreamClient lets the agent batch log entries and flush
+// them in one client-streaming call.
+type Woodpecker_LogStreamClient interface {
+	Send(*LogRequest) error
+	CloseAndRecv() (*LogResponse, error)
+	grpc.ClientStream
+}
+
+// Woodpecker_CancelClient delivers workflow IDs the server wants the agent
+// to abort.
+type Woodpecker_CancelClient interface {
+	Recv() (*CancelResponse, error)
+	grpc.ClientStream
+}
+
+// WoodpeckerClient is the agent-side interface to the server's grpc API.
+type WoodpeckerClient interface {
+	Version(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*VersionResponse, error)
+	Next(ctx context.Context, in *NextRequest, opts ...grpc.CallOption) (*NextResponse, error)
+	NextStream(ctx context.Context, opts ...grpc.CallOption) (Woodpecker_NextStreamClient, error)
+	Wait(ctx context.Context, in *WaitRequest, opts ...grpc.CallOption) (*WaitResponse, error)
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	Done(ctx context.Context, in *DoneRequest, opts ...grpc.CallOption) (*DoneResponse, error)
+	Extend(ctx context.Context, in *ExtendRequest, opts ...grpc.CallOption) (*ExtendResponse, error)
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error)
+	Log(ctx context.Context, in *LogRequest, opts ...grpc.CallOption) (*LogResponse, error)
+	LogStream(ctx context.Context, opts ...grpc.CallOption) (Woodpecker_LogStreamClient, error)
+	Cancel(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Woodpecker_CancelClient, error)
+	RegisterAgent(ctx context.Context, in *RegisterAgentRequest, opts ...grpc.CallOption) (*RegisterAgentResponse, error)
+	UnregisterAgent(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	ReportHealth(ctx context.Context, in *ReportHealthRequest, opts ...grpc.CallOption) (*ReportHealthResponse, error)
+}
+
+type woodpeckerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewWoodpeckerClient returns a WoodpeckerClient backed by conn.
+func NewWoodpeckerClient(cc grpc.ClientConnInterface) WoodpeckerClient {
+	return &woodpeckerClient{cc}
+}
+
+func (c *woodpeckerClient) Version(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*VersionResponse, error) {
+	out := new(VersionResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Version", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Next(ctx context.Context, in *NextRequest, opts ...grpc.CallOption) (*NextResponse, error) {
+	out := new(NextResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Next", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) NextStream(ctx context.Context, opts ...grpc.CallOption) (Woodpecker_NextStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "NextStream", ServerStreams: true, ClientStreams: true}, serviceName+"/NextStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &woodpeckerNextStreamClient{stream}, nil
+}
+
+type woodpeckerNextStreamClient struct{ grpc.ClientStream }
+
+func (s *woodpeckerNextStreamClient) Send(req *NextRequest) error {
+	return s.ClientStream.SendMsg(req)
+}
+
+func (s *woodpeckerNextStreamClient) Recv() (*NextResponse, error) {
+	out := new(NextResponse)
+	if err := s.ClientStream.RecvMsg(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Wait(ctx context.Context, in *WaitRequest, opts ...grpc.CallOption) (*WaitResponse, error) {
+	out := new(WaitResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Wait", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	out := new(InitResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Init", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Done(ctx context.Context, in *DoneRequest, opts ...grpc.CallOption) (*DoneResponse, error) {
+	out := new(DoneResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Done", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Extend(ctx context.Context, in *ExtendRequest, opts ...grpc.CallOption) (*ExtendResponse, error) {
+	out := new(ExtendResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Extend", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error) {
+	out := new(UpdateResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Update", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Log(ctx context.Context, in *LogRequest, opts ...grpc.CallOption) (*LogResponse, error) {
+	out := new(LogResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/Log", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) LogStream(ctx context.Context, opts ...grpc.CallOption) (Woodpecker_LogStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "LogStream", ClientStreams: true}, serviceName+"/LogStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &woodpeckerLogStreamClient{stream}, nil
+}
+
+type woodpeckerLogStreamClient struct{ grpc.ClientStream }
+
+func (s *woodpeckerLogStreamClient) Send(req *LogRequest) error {
+	return s.ClientStream.SendMsg(req)
+}
+
+func (s *woodpeckerLogStreamClient) CloseAndRecv() (*LogResponse, error) {
+	if err := s.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	out := new(LogResponse)
+	if err := s.ClientStream.RecvMsg(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) Cancel(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Woodpecker_CancelClient, error) {
+	stream, err := c.cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "Cancel", ServerStreams: true}, serviceName+"/Cancel", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &woodpeckerCancelClient{stream}, nil
+}
+
+type woodpeckerCancelClient struct{ grpc.ClientStream }
+
+func (s *woodpeckerCancelClient) Recv() (*CancelResponse, error) {
+	out := new(CancelResponse)
+	if err := s.ClientStream.RecvMsg(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) RegisterAgent(ctx context.Context, in *RegisterAgentRequest, opts ...grpc.CallOption) (*RegisterAgentResponse, error) {
+	out := new(RegisterAgentResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/RegisterAgent", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) UnregisterAgent(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	if err := c.cc.Invoke(ctx, serviceName+"/UnregisterAgent", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *woodpeckerClient) ReportHealth(ctx context.Context, in *ReportHealthRequest, opts ...grpc.CallOption) (*ReportHealthResponse, error) {
+	out := new(ReportHealthResponse)
+	if err := c.cc.Invoke(ctx, serviceName+"/ReportHealth", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpc defines the transport-agnostic contract between a server and
+// its agents; packages agent/rpc and server/grpc implement it over grpc.
+package rpc
+
+import (
+	"context"
+
+	backend "go.woodpecker-ci.org/woodpecker/v2/pipeline/backend/types"
+)
+
+// Peer is the server-side API an agent uses to pull and report on work.
+type Peer interface {
+	Close() error
+	Version(ctx context.Context) (*Version, error)
+	Next(ctx context.Context, f Filter) (*Workflow, error)
+	// Cancelled streams workflow IDs the server wants this agent to abort.
+	Cancelled(ctx context.Context) <-chan string
+	Wait(ctx context.Context, id string) error
+	Init(ctx context.Context, id string, state State) error
+	Done(ctx context.Context, id string, state State) error
+	Extend(ctx context.Context, id string) error
+	Update(ctx context.Context, id string, state State) error
+	Log(ctx context.Context, logEntry *LogEntry) error
+	RegisterAgent(ctx context.Context, platform, backend, version string, capacity int) (int64, error)
+	UnregisterAgent(ctx context.Context) error
+	ReportHealth(ctx context.Context) error
+}
+
+// Version identifies the grpc protocol and server build an agent talks to.
+type Version struct {
+	GrpcVersion   int32
+	ServerVersion string
+}
+
+// Filter narrows which workflows an agent is willing to run.
+type Filter struct {
+	Labels map[string]string
+}
+
+// Workflow is a schedulable unit of work handed out by Next.
+type Workflow struct {
+	ID      string
+	Timeout int64
+	Config  *backend.Config
+}
+
+// State reports the progress of a single step.
+type State struct {
+	StepUUID string
+	Error    string
+	ExitCode int
+	Exited   bool
+	Started  int64
+	Finished int64
+}
+
+// LogEntry is a single line of step output.
+type LogEntry struct {
+	StepUUID string
+	Data     []byte
+	Line     int
+	Time     int64
+	Type     int
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpc wires the grpc service defined in pipeline/rpc/proto to a
+// server/queue.Queue.
+package grpc
+
+import (
+	"context"
+	"sync"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// RPC is the server-side counterpart to agent/rpc.client: it resolves
+// incoming grpc calls against a queue.Queue.
+type RPC struct {
+	queue queue.Queue
+
+	mu      sync.Mutex
+	cancels map[int64]chan string // agentID -> workflow IDs pending cancellation
+}
+
+// NewRPC returns an RPC backed by q.
+func NewRPC(q queue.Queue) *RPC {
+	return &RPC{
+		queue:   q,
+		cancels: map[int64]chan string{},
+	}
+}
+
+// Next hands agentID the next task matching labels and f, blocking until
+// one is available or ctx is done.
+func (s *RPC) Next(ctx context.Context, agentID int64, labels labelmatch.Labels, f queue.FilterFn) (*model.Task, error) {
+	return s.queue.Poll(ctx, agentID, labels, f)
+}
+
+// CancelWorkflow cancels a running workflow, forwarding the cancellation to
+// whichever agent it is currently assigned to over that agent's open
+// Cancel stream.
+func (s *RPC) CancelWorkflow(ctx context.Context, id string) error {
+	agentID, err := s.queue.Cancel(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	ch, ok := s.cancels[agentID]
+	s.mu.Unlock()
+	if !ok {
+		return nil // agent has no open Cancel stream right now; nothing to push
+	}
+
+	select {
+	case ch <- id:
+	default:
+		// agent's cancel channel is full; this cancellation is dropped
+		// rather than blocking the caller.
+	}
+	return nil
+}
+
+// agentCancelStream returns the channel that CancelWorkflow pushes an
+// agent's to-be-cancelled workflow IDs into, creating it on first use.
+func (s *RPC) agentCancelStream(agentID int64) chan string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.cancels[agentID]
+	if !ok {
+		ch = make(chan string, 1)
+		s.cancels[agentID] = ch
+	}
+	return ch
+}
+
+// closeAgentCancelStream drops the cancel channel for an agent whose
+// Cancel stream disconnected.
+func (s *RPC) closeAgentCancelStream(agentID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cancels, agentID)
+}
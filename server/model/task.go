@@ -0,0 +1,74 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "time"
+
+// StatusValue is the terminal (or in-flight) state of a task as reported
+// back to the queue.
+type StatusValue string
+
+const (
+	StatusSuccess StatusValue = "success"
+	StatusFailure StatusValue = "failure"
+	StatusKilled  StatusValue = "killed"
+)
+
+// Preferred is a soft-matched label: a worker that has it gets Weight added
+// to its score, but a worker without it is still eligible. It lives here
+// rather than in server/queue/labelmatch so that package can depend on
+// model instead of the other way around.
+type Preferred struct {
+	Key    string
+	Value  string
+	Weight float64
+}
+
+// Task is a unit of work handed out by the queue to an agent.
+type Task struct {
+	ID           string                 `json:"id"`
+	Data         []byte                 `json:"data"`
+	Labels       map[string]string      `json:"labels"`
+	Dependencies []string               `json:"dependencies"`
+	RunOn        []string               `json:"run_on"`
+	DepStatus    map[string]StatusValue `json:"dep_status"`
+
+	AgentID int64 `json:"agent_id"`
+
+	// OwnerKey groups tasks (e.g. by org or repo) for weighted fair-share
+	// scheduling across owners; empty falls back to a shared default.
+	OwnerKey string `json:"owner_key,omitempty"`
+	// Priority nudges how often this task's owner gets scheduled relative
+	// to its peers; <= 0 is treated as the default priority of 1.
+	Priority int `json:"priority,omitempty"`
+
+	// RequiredLabels must all be present on a worker for it to be
+	// eligible to run this task.
+	RequiredLabels map[string]string `json:"required_labels,omitempty"`
+	// PreferredLabels are soft-matched and scored, letting the scheduler
+	// pick the best of several eligible workers.
+	PreferredLabels []Preferred `json:"preferred_labels,omitempty"`
+
+	// Attempts counts how many times this task's deadline has expired
+	// without a Done/Error.
+	Attempts int `json:"attempts,omitempty"`
+	// MaxAttempts overrides how many times this task's deadline may expire
+	// before it is failed outright instead of requeued, i.e. it is requeued
+	// at most MaxAttempts-1 times; <= 0 is treated as the queue's default.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// NotBefore holds this task back from Poll until the given time, used to
+	// back off a requeued task rather than retrying it immediately.
+	NotBefore time.Time `json:"not_before,omitempty"`
+}
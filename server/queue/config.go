@@ -0,0 +1,50 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import "time"
+
+// Backend selects which Queue implementation New constructs.
+type Backend string
+
+const (
+	// BackendMemory is the single-process in-memory fifo queue. Tasks do
+	// not survive a server restart and are not shared across replicas.
+	BackendMemory Backend = "memory"
+	// BackendEtcd persists queue state in etcd so multiple server replicas
+	// can share one queue and tasks survive a server restart.
+	BackendEtcd Backend = "etcd"
+)
+
+// Config selects and configures the Queue backend New constructs. The zero
+// value selects BackendMemory.
+type Config struct {
+	Backend Backend
+	Etcd    EtcdConfig
+}
+
+// EtcdConfig configures the etcd-backed persistent queue.
+type EtcdConfig struct {
+	Endpoints []string
+	// Prefix is the etcd key prefix all queue entries are stored under,
+	// e.g. "/woodpecker/queue".
+	Prefix string
+	// DialTimeout bounds how long New waits to connect to etcd.
+	DialTimeout time.Duration
+	// TaskLeaseTTL is how long a claimed task stays claimed without the
+	// agent calling Extend; once it expires the task becomes pollable
+	// again without any server having to notice the crash.
+	TaskLeaseTTL time.Duration
+}
@@ -0,0 +1,503 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rs/zerolog/log"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// defaultPollInterval is how often Poll re-scans pending tasks when nothing
+// claimable was found on the previous pass.
+const defaultPollInterval = 500 * time.Millisecond
+
+// runningLock is the value stored under a task's running key. It carries
+// the lease backing the claim so Extend can renew it from any replica,
+// not just the one that claimed the task.
+type runningLock struct {
+	AgentID   int64 `json:"agent_id"`
+	Lease     int64 `json:"lease"`
+	Cancelled bool  `json:"cancelled,omitempty"`
+}
+
+// etcdQueue is a Queue implementation that stores pending and running task
+// state in etcd so it survives a server restart and can be shared by
+// multiple server replicas behind a load balancer. A task is "claimed" by
+// creating its running key under a lease; when that lease expires (because
+// the server holding it crashed and stopped extending it) etcd removes the
+// running key on its own and the task becomes pollable again.
+type etcdQueue struct {
+	cli    *clientv3.Client
+	prefix string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	workers map[*worker]struct{}
+}
+
+func newEtcdQueue(ctx context.Context, conf EtcdConfig) (Queue, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   conf.Endpoints,
+		DialTimeout: conf.DialTimeout,
+		Context:     ctx,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("queue: could not connect to etcd: %w", err)
+	}
+
+	ttl := conf.TaskLeaseTTL
+	if ttl <= 0 {
+		ttl = time.Minute * 10
+	}
+
+	return &etcdQueue{
+		cli:     cli,
+		prefix:  conf.Prefix,
+		ttl:     ttl,
+		workers: map[*worker]struct{}{},
+	}, nil
+}
+
+func (q *etcdQueue) pendingKey(id string) string { return q.prefix + "/pending/" + id }
+func (q *etcdQueue) runningKey(id string) string { return q.prefix + "/running/" + id }
+func (q *etcdQueue) doneKey(id string) string    { return q.prefix + "/done/" + id }
+
+// statusKey holds a task's terminal status permanently (unlike doneKey,
+// which only exists long enough for in-flight Wait() watchers to observe
+// it), so depsSatisfied can report a dependency's real outcome to whichever
+// dependent happens to poll long after it finished.
+func (q *etcdQueue) statusKey(id string) string { return q.prefix + "/status/" + id }
+func (q *etcdQueue) pausedKey() string           { return q.prefix + "/paused" }
+
+func (q *etcdQueue) Push(ctx context.Context, task *model.Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = q.cli.Put(ctx, q.pendingKey(task.ID), string(data))
+	return err
+}
+
+func (q *etcdQueue) PushAtOnce(ctx context.Context, tasks []*model.Task) error {
+	for _, task := range tasks {
+		if err := q.Push(ctx, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Poll retrieves and claims a pending task matching f and labels, blocking
+// until one is available or ctx is done. Unlike the fifo backend, claims
+// are first-fit in submission order: scoring PreferredLabels across every
+// concurrently-polling replica would need a cluster-wide transaction this
+// backend doesn't attempt yet, so only RequiredLabels are enforced.
+func (q *etcdQueue) Poll(ctx context.Context, agentID int64, labels labelmatch.Labels, f FilterFn) (*model.Task, error) {
+	ctx, stop := context.WithCancelCause(ctx)
+	w := &worker{agentID: agentID, labels: labels, stop: stop}
+	q.mu.Lock()
+	q.workers[w] = struct{}{}
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.workers, w)
+		q.mu.Unlock()
+		stop(nil)
+	}()
+
+	for {
+		if paused, err := q.isPaused(ctx); err == nil && paused {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(defaultPollInterval):
+				continue
+			}
+		}
+
+		task, err := q.tryClaim(ctx, agentID, labels, f)
+		if err != nil {
+			return nil, err
+		}
+		if task != nil {
+			return task, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(defaultPollInterval):
+		}
+	}
+}
+
+func (q *etcdQueue) tryClaim(ctx context.Context, agentID int64, labels labelmatch.Labels, f FilterFn) (*model.Task, error) {
+	resp, err := q.cli.Get(ctx, q.prefix+"/pending/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kv := range resp.Kvs {
+		var task model.Task
+		if err := json.Unmarshal(kv.Value, &task); err != nil {
+			log.Error().Err(err).Msgf("queue: could not decode pending task %s", kv.Key)
+			continue
+		}
+		if !f(&task) {
+			continue
+		}
+		if !labelmatch.Matches(task.RequiredLabels, labels) {
+			continue
+		}
+
+		satisfied, err := q.depsSatisfied(ctx, &task)
+		if err != nil {
+			return nil, err
+		}
+		if !satisfied {
+			continue
+		}
+
+		lease, err := q.cli.Grant(ctx, int64(q.ttl.Seconds()))
+		if err != nil {
+			return nil, err
+		}
+
+		lock, err := json.Marshal(runningLock{AgentID: agentID, Lease: int64(lease.ID)})
+		if err != nil {
+			return nil, err
+		}
+
+		txn, err := q.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.Version(q.runningKey(task.ID)), "=", 0)).
+			Then(clientv3.OpPut(q.runningKey(task.ID), string(lock), clientv3.WithLease(lease.ID))).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+		if !txn.Succeeded {
+			// another replica claimed it first; let the lease we granted expire on its own.
+			continue
+		}
+
+		task.AgentID = agentID
+		return &task, nil
+	}
+
+	return nil, nil
+}
+
+// depsSatisfied reports whether every one of task's Dependencies has
+// finished, i.e. neither its pending nor its running key still exists in
+// etcd, and records each dependency's real terminal status (if it finished
+// through finish() rather than being evicted) into task.DepStatus, mirroring
+// fifo.updateDepStatusInQueue.
+func (q *etcdQueue) depsSatisfied(ctx context.Context, task *model.Task) (bool, error) {
+	for _, dep := range task.Dependencies {
+		resp, err := q.cli.Get(ctx, q.pendingKey(dep))
+		if err != nil {
+			return false, err
+		}
+		if len(resp.Kvs) > 0 {
+			return false, nil
+		}
+
+		resp, err = q.cli.Get(ctx, q.runningKey(dep))
+		if err != nil {
+			return false, err
+		}
+		if len(resp.Kvs) > 0 {
+			return false, nil
+		}
+
+		// dep is done (or was evicted, or never existed); neither of those
+		// should block this task. If it actually finished through
+		// finish(), report its real status to the dependent - best effort,
+		// since an evicted dependency never gets one.
+		resp, err = q.cli.Get(ctx, q.statusKey(dep))
+		if err != nil {
+			return false, err
+		}
+		if len(resp.Kvs) > 0 {
+			var rec doneRecord
+			if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+				return false, err
+			}
+			if task.DepStatus == nil {
+				task.DepStatus = map[string]model.StatusValue{}
+			}
+			task.DepStatus[dep] = rec.Status
+		}
+	}
+	return true, nil
+}
+
+func (q *etcdQueue) isPaused(ctx context.Context) (bool, error) {
+	resp, err := q.cli.Get(ctx, q.pausedKey())
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Kvs) > 0, nil
+}
+
+func (q *etcdQueue) Extend(ctx context.Context, id string) error {
+	resp, err := q.cli.Get(ctx, q.runningKey(id))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ErrNotFound
+	}
+
+	var lock runningLock
+	if err := json.Unmarshal(resp.Kvs[0].Value, &lock); err != nil {
+		return err
+	}
+
+	_, err = q.cli.KeepAliveOnce(ctx, clientv3.LeaseID(lock.Lease))
+	if err != nil && status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (q *etcdQueue) Done(ctx context.Context, id string, exitStatus model.StatusValue) error {
+	return q.finish(ctx, id, exitStatus, nil)
+}
+
+func (q *etcdQueue) Error(ctx context.Context, id string, err error) error {
+	return q.finish(ctx, id, model.StatusFailure, err)
+}
+
+func (q *etcdQueue) ErrorAtOnce(ctx context.Context, ids []string, err error) error {
+	for _, id := range ids {
+		if ferr := q.finish(ctx, id, model.StatusFailure, err); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// doneRecord is the value published under doneKey, carrying the task's
+// terminal status so Wait() can tell a failure/cancellation from success
+// instead of only ever seeing "was there an error string".
+type doneRecord struct {
+	Status model.StatusValue `json:"status"`
+	Err    string            `json:"err,omitempty"`
+}
+
+func (q *etcdQueue) finish(ctx context.Context, id string, exitStatus model.StatusValue, taskErr error) error {
+	resp, err := q.cli.Get(ctx, q.runningKey(id))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) > 0 {
+		var lock runningLock
+		if err := json.Unmarshal(resp.Kvs[0].Value, &lock); err == nil && lock.Cancelled {
+			// Cancel() raced with (or preceded) the agent's own report; the
+			// task was killed, not failed or succeeded on its own.
+			exitStatus, taskErr = model.StatusKilled, nil
+		}
+	}
+
+	rec := doneRecord{Status: exitStatus}
+	if taskErr != nil {
+		rec.Err = taskErr.Error()
+	}
+	msg, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	// published under a short-lived lease purely so Wait() watchers on any
+	// replica observe completion; it is cleaned up on its own afterwards.
+	lease, err := q.cli.Grant(ctx, 60)
+	if err != nil {
+		return err
+	}
+	if _, err := q.cli.Put(ctx, q.doneKey(id), string(msg), clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+	if _, err := q.cli.Put(ctx, q.statusKey(id), string(msg)); err != nil {
+		return err
+	}
+
+	if _, err := q.cli.Delete(ctx, q.pendingKey(id)); err != nil {
+		return err
+	}
+	_, err = q.cli.Delete(ctx, q.runningKey(id))
+	return err
+}
+
+func (q *etcdQueue) Evict(ctx context.Context, id string) error {
+	return q.EvictAtOnce(ctx, []string{id})
+}
+
+// Cancel marks a running task as cancelled and returns the agent it is
+// currently assigned to, so the caller can forward the cancellation to that
+// agent. The cancelled flag is persisted on the running lock (under its
+// existing lease, so a crashed agent's lease expiry still reclaims it as
+// usual) so that whatever the agent later reports through Done/Error is
+// overridden to StatusKilled in finish, the same way the in-memory fifo
+// backend does.
+func (q *etcdQueue) Cancel(ctx context.Context, id string) (int64, error) {
+	resp, err := q.cli.Get(ctx, q.runningKey(id))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, ErrNotFound
+	}
+
+	var lock runningLock
+	if err := json.Unmarshal(resp.Kvs[0].Value, &lock); err != nil {
+		return 0, err
+	}
+	lock.Cancelled = true
+
+	msg, err := json.Marshal(lock)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.cli.Put(ctx, q.runningKey(id), string(msg), clientv3.WithLease(clientv3.LeaseID(lock.Lease))); err != nil {
+		return 0, err
+	}
+
+	return lock.AgentID, nil
+}
+
+func (q *etcdQueue) EvictAtOnce(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		resp, err := q.cli.Get(ctx, q.runningKey(id))
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) > 0 {
+			return ErrNotFound // task already claimed, nothing pending left to evict
+		}
+
+		resp, err = q.cli.Delete(ctx, q.pendingKey(id))
+		if err != nil {
+			return err
+		}
+		if resp.Deleted == 0 {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+// Wait blocks until the task finishes, by watching for its done marker so
+// it works regardless of which replica's Poll claimed the task.
+func (q *etcdQueue) Wait(ctx context.Context, id string) error {
+	// the task may already have finished before Wait was called: start the
+	// watch early enough to replay its done marker if it is already there.
+	resp, err := q.cli.Get(ctx, q.doneKey(id))
+	if err != nil {
+		return err
+	}
+	rev := resp.Header.Revision + 1
+	if len(resp.Kvs) > 0 {
+		rev = resp.Kvs[0].ModRevision
+	}
+	watch := q.cli.Watch(ctx, q.doneKey(id), clientv3.WithRev(rev))
+	for resp := range watch {
+		for _, ev := range resp.Events {
+			if ev.Type != clientv3.EventTypePut {
+				continue
+			}
+
+			var rec doneRecord
+			if err := json.Unmarshal(ev.Kv.Value, &rec); err != nil {
+				return err
+			}
+			if rec.Status == model.StatusSuccess {
+				return nil
+			}
+			if rec.Err != "" {
+				return fmt.Errorf("%s", rec.Err)
+			}
+			return fmt.Errorf("task finished with status %s", rec.Status)
+		}
+	}
+	return ctx.Err()
+}
+
+func (q *etcdQueue) Info(ctx context.Context) InfoT {
+	stats := InfoT{}
+
+	if resp, err := q.cli.Get(ctx, q.prefix+"/pending/", clientv3.WithPrefix()); err == nil {
+		stats.Stats.Pending = len(resp.Kvs)
+		for _, kv := range resp.Kvs {
+			var task model.Task
+			if json.Unmarshal(kv.Value, &task) == nil {
+				stats.Pending = append(stats.Pending, &task)
+			}
+		}
+	}
+	if resp, err := q.cli.Get(ctx, q.prefix+"/running/", clientv3.WithPrefix()); err == nil {
+		stats.Stats.Running = len(resp.Kvs)
+	}
+	if paused, err := q.isPaused(ctx); err == nil {
+		stats.Paused = paused
+	}
+
+	q.mu.Lock()
+	stats.Stats.Workers = len(q.workers)
+	q.mu.Unlock()
+
+	return stats
+}
+
+func (q *etcdQueue) Pause() {
+	//nolint:errcheck
+	q.cli.Put(context.Background(), q.pausedKey(), "1")
+}
+
+func (q *etcdQueue) Resume() {
+	//nolint:errcheck
+	q.cli.Delete(context.Background(), q.pausedKey())
+}
+
+// KickAgentWorkers cancels this replica's in-flight Poll calls for the
+// agent; other replicas are unaffected, same as them not seeing a local
+// *worker for this agentID.
+func (q *etcdQueue) KickAgentWorkers(agentID int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for w := range q.workers {
+		if w.agentID == agentID && w.stop != nil {
+			w.stop(fmt.Errorf("worker was kicked"))
+		}
+	}
+}
+
+// SetOwnerWeight is accepted for interface compatibility with fifo, but the
+// etcd backend currently claims pending tasks in FIFO order without
+// per-owner fair-share accounting.
+func (q *etcdQueue) SetOwnerWeight(_ string, _ float64) {}
@@ -0,0 +1,205 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+
+// This file needs a real etcd cluster (set WOODPECKER_TEST_ETCD_ENDPOINTS)
+// and is excluded from `go test ./...`; run it with `go test -tags
+// integration ./server/queue/...`.
+
+package queue
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+func newTestEtcdQueue(t *testing.T) *etcdQueue {
+	t.Helper()
+	endpoints := os.Getenv("WOODPECKER_TEST_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("WOODPECKER_TEST_ETCD_ENDPOINTS not set")
+	}
+
+	q, err := newEtcdQueue(context.Background(), EtcdConfig{
+		Endpoints:    strings.Split(endpoints, ","),
+		Prefix:       "/woodpecker-test/" + t.Name(),
+		DialTimeout:  5 * time.Second,
+		TaskLeaseTTL: time.Second,
+	})
+	require.NoError(t, err)
+	return q.(*etcdQueue)
+}
+
+// TestEtcdClaimIsExclusive asserts that two replicas racing to claim the
+// same pending task never both win: the losing replica's Txn fails and it
+// keeps polling instead.
+func TestEtcdClaimIsExclusive(t *testing.T) {
+	replicaA := newTestEtcdQueue(t)
+	replicaB := newTestEtcdQueue(t)
+	replicaB.prefix = replicaA.prefix // same cluster-wide queue, two "servers"
+
+	task := &model.Task{ID: "claim-me"}
+	require.NoError(t, replicaA.Push(context.Background(), task))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	results := make(chan *model.Task, 2)
+	for _, q := range []*etcdQueue{replicaA, replicaB} {
+		go func(q *etcdQueue) {
+			got, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+			assert.NoError(t, err)
+			results <- got
+		}(q)
+	}
+
+	var claimed int
+	for i := 0; i < 2; i++ {
+		if <-results != nil {
+			claimed++
+		}
+	}
+	assert.Equal(t, 1, claimed, "exactly one replica should win the claim")
+}
+
+// TestEtcdDependencyGating asserts a task isn't claimable until every one
+// of its dependencies has finished.
+func TestEtcdDependencyGating(t *testing.T) {
+	q := newTestEtcdQueue(t)
+	ctx := context.Background()
+
+	require.NoError(t, q.PushAtOnce(ctx, []*model.Task{
+		{ID: "base"},
+		{ID: "dependent", Dependencies: []string{"base"}},
+	}))
+
+	got, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "base", got.ID, "dependent must not be claimable before base finishes")
+
+	require.NoError(t, q.Done(ctx, "base", model.StatusSuccess))
+
+	got, err = q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "dependent", got.ID)
+}
+
+// TestEtcdDependencyGatingReportsRealStatus asserts that once a dependency
+// finishes, the dependent picks up its actual terminal status in DepStatus
+// instead of just being unblocked.
+func TestEtcdDependencyGatingReportsRealStatus(t *testing.T) {
+	q := newTestEtcdQueue(t)
+	ctx := context.Background()
+
+	dependent := &model.Task{ID: "dependent", Dependencies: []string{"base"}, DepStatus: map[string]model.StatusValue{}}
+	require.NoError(t, q.PushAtOnce(ctx, []*model.Task{
+		{ID: "base"},
+		dependent,
+	}))
+
+	got, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Equal(t, "base", got.ID)
+
+	require.NoError(t, q.Done(ctx, "base", model.StatusFailure))
+
+	got, err = q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "dependent", got.ID)
+	assert.Equal(t, model.StatusFailure, got.DepStatus["base"])
+}
+
+// TestEtcdWaitReportsFailureStatus asserts Wait surfaces a Done(id,
+// StatusFailure) call as an error even when no error object was given,
+// instead of reporting success because nothing was ever recorded.
+func TestEtcdWaitReportsFailureStatus(t *testing.T) {
+	q := newTestEtcdQueue(t)
+	ctx := context.Background()
+
+	require.NoError(t, q.Push(ctx, &model.Task{ID: "fails-silently"}))
+	_, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+
+	require.NoError(t, q.Done(ctx, "fails-silently", model.StatusFailure))
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	assert.Error(t, q.Wait(waitCtx, "fails-silently"))
+}
+
+// TestEtcdCancelOverridesReportedStatus asserts that once Cancel has been
+// called for a running task, whatever the agent later reports through
+// Done/Error can't make it look like a normal success or failure: Wait
+// surfaces it as killed instead.
+func TestEtcdCancelOverridesReportedStatus(t *testing.T) {
+	q := newTestEtcdQueue(t)
+	ctx := context.Background()
+
+	require.NoError(t, q.Push(ctx, &model.Task{ID: "cancel-me"}))
+	got, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+
+	agentID, err := q.Cancel(ctx, "cancel-me")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), agentID)
+
+	// the agent raced the cancellation and reported its own success; the
+	// cancellation should win over whatever it said.
+	require.NoError(t, q.Done(ctx, "cancel-me", model.StatusSuccess))
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err = q.Wait(waitCtx, "cancel-me")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), string(model.StatusKilled))
+}
+
+// TestEtcdSurvivesReplicaRestart asserts a task claimed by a replica that
+// then crashes (stops extending its lease) becomes pollable again once the
+// lease expires, rather than being stuck forever.
+func TestEtcdSurvivesReplicaRestart(t *testing.T) {
+	q := newTestEtcdQueue(t)
+	ctx := context.Background()
+
+	require.NoError(t, q.Push(ctx, &model.Task{ID: "outlives-its-claimer"}))
+
+	got, err := q.tryClaim(ctx, 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, got)
+
+	// simulate the replica that claimed it crashing: nobody calls Extend,
+	// so the lease granted in tryClaim (TaskLeaseTTL: 1s) lapses on its own.
+	time.Sleep(2 * time.Second)
+
+	retryCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	got, err = q.Poll(retryCtx, 2, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	require.NoError(t, err)
+	assert.Equal(t, "outlives-its-claimer", got.ID)
+}
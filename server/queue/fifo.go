@@ -15,58 +15,245 @@
 package queue
 
 import (
+	"container/heap"
 	"container/list"
 	"context"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/rs/zerolog/log"
 
 	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
 )
 
+// defaultOwner is the owner key used for tasks that do not set one, so the
+// queue behaves like a plain FIFO until callers opt into per-owner fairness.
+const defaultOwner = "default"
+
+// defaultOwnerWeight is the weight assigned to an owner until SetOwnerWeight
+// is called for it.
+const defaultOwnerWeight = 1.0
+
+// defaultMaxAttempts bounds how many times a task's deadline may expire
+// before it is failed outright (so it is requeued at most
+// defaultMaxAttempts-1 times), for tasks that don't set their own
+// MaxAttempts.
+const defaultMaxAttempts = 3
+
+// resubmitInterval is how often the queue re-checks for expired deadlines
+// and elapsed requeue backoffs on its own, so a task isn't stuck waiting for
+// some unrelated Push/Poll/Resume call to notice it's due.
+const resubmitInterval = time.Second
+
+// requeueBackoff returns the exponential, capped delay to wait before a
+// task that just expired for the nth time becomes schedulable again, using
+// the same shape of backoff the agent uses to retry RPCs.
+func requeueBackoff(attempt int) time.Duration {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 30 * time.Second
+	b.MaxInterval = 30 * time.Minute
+	b.Multiplier = 2
+
+	var delay time.Duration
+	for i := 0; i < attempt; i++ {
+		delay = b.NextBackOff()
+	}
+	return delay
+}
+
 type entry struct {
-	item     *model.Task
-	done     chan bool
-	error    error
-	deadline time.Time
+	item      *model.Task
+	done      chan bool
+	error     error
+	deadline  time.Time
+	cancelled bool
+	// retrying is set while the task is sitting out its requeue backoff
+	// after an expired deadline: it has been pushed back into its owner's
+	// pending queue but hasn't been reassigned to a worker yet, so it isn't
+	// actually running and resubmitExpiredPipelines must leave it alone
+	// until process() hands it out again.
+	retrying bool
 }
 
 type worker struct {
 	agentID int64
 	filter  FilterFn
+	labels  labelmatch.Labels
+	seq     int64 // registration order, used to break scoring ties FIFO-style
 	channel chan *model.Task
 	stop    context.CancelCauseFunc
 }
 
+// ownerQueue is the FIFO of pending tasks belonging to a single owner (e.g.
+// an org or repo), along with the bookkeeping needed for weighted fair
+// scheduling across owners.
+type ownerQueue struct {
+	owner       string
+	weight      float64
+	virtualTime float64
+	tasks       *list.List
+	index       int // heap index, maintained by ownerHeap
+}
+
+// ownerHeap is a min-heap of ownerQueues ordered by virtual time, so the
+// owner that is furthest behind in its fair share is always tried first.
+// An owner joins the heap when it gains a pending task; one whose tasks were
+// all evicted or moved to waitingOnDeps stays in it until assignToWorker
+// pops it and drops it.
+type ownerHeap []*ownerQueue
+
+func (h ownerHeap) Len() int            { return len(h) }
+func (h ownerHeap) Less(i, j int) bool  { return h[i].virtualTime < h[j].virtualTime }
+func (h ownerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i]; h[i].index = i; h[j].index = j }
+func (h *ownerHeap) Push(x any) {
+	oq := x.(*ownerQueue) //nolint:forcetypeassert
+	oq.index = len(*h)
+	*h = append(*h, oq)
+}
+
+func (h *ownerHeap) Pop() any {
+	old := *h
+	n := len(old)
+	oq := old[n-1]
+	old[n-1] = nil
+	oq.index = -1
+	*h = old[:n-1]
+	return oq
+}
+
+// OwnerStats reports the fairness bookkeeping for a single owner, surfaced
+// through Info() so operators can see who is getting scheduled.
+type OwnerStats struct {
+	Owner       string
+	Pending     int
+	Weight      float64
+	VirtualTime float64
+}
+
 type fifo struct {
 	sync.Mutex
 
 	workers       map[*worker]struct{}
+	nextSeq       int64
 	running       map[string]*entry
-	pending       *list.List
+	owners        map[string]*ownerQueue
+	// weights holds explicit per-owner weights set via SetOwnerWeight,
+	// independent of owners so a configured weight survives an owner's
+	// ownerQueue being pruned once it drains.
+	weights       map[string]float64
+	ownerHeap     ownerHeap
 	waitingOnDeps *list.List
 	extension     time.Duration
 	paused        bool
 }
 
-// New returns a new fifo queue.
-func New(_ context.Context) Queue {
-	return &fifo{
+// New returns a new Queue backed by the implementation selected in conf.
+// The zero Config selects the in-memory fifo backend.
+func New(ctx context.Context, conf Config) (Queue, error) {
+	switch conf.Backend {
+	case BackendEtcd:
+		return newEtcdQueue(ctx, conf.Etcd)
+	case BackendMemory, "":
+		return newFifo(), nil
+	default:
+		return nil, fmt.Errorf("queue: unknown backend %q", conf.Backend)
+	}
+}
+
+// newFifo returns a new in-memory fifo queue.
+func newFifo() *fifo {
+	q := &fifo{
 		workers:       map[*worker]struct{}{},
 		running:       map[string]*entry{},
-		pending:       list.New(),
+		owners:        map[string]*ownerQueue{},
+		weights:       map[string]float64{},
 		waitingOnDeps: list.New(),
 		extension:     time.Minute * 10,
 		paused:        false,
 	}
+	go q.resubmitLoop()
+	return q
+}
+
+// resubmitLoop periodically re-runs process() so expired deadlines and
+// elapsed requeue backoffs are acted on even on an otherwise quiet queue,
+// instead of only when some Push/Poll/Resume call happens to trigger it.
+func (q *fifo) resubmitLoop() {
+	ticker := time.NewTicker(resubmitInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.process()
+	}
+}
+
+// ownerKeyOf returns the owner a task should be fair-shared under, falling
+// back to a shared default bucket so unset OwnerKey behaves like plain FIFO.
+func ownerKeyOf(task *model.Task) string {
+	if task.OwnerKey != "" {
+		return task.OwnerKey
+	}
+	return defaultOwner
+}
+
+// priorityFactor turns a task's priority into a virtual-time multiplier:
+// higher priority tasks cost their owner less virtual time, so that owner
+// is more likely to be picked again sooner. Priority <= 0 is treated as 1.
+func priorityFactor(priority int) float64 {
+	if priority <= 0 {
+		return 1
+	}
+	return float64(priority)
+}
+
+// pushTask appends a task to its owner's pending queue, registering the
+// owner (and putting it back in the scheduling heap) if needed. Caller must
+// hold the lock.
+func (q *fifo) pushTask(task *model.Task) {
+	owner := ownerKeyOf(task)
+	oq, ok := q.owners[owner]
+	if !ok {
+		weight := defaultOwnerWeight
+		if w, ok := q.weights[owner]; ok {
+			weight = w
+		}
+		oq = &ownerQueue{owner: owner, weight: weight, tasks: list.New(), index: -1}
+		q.owners[owner] = oq
+	}
+	wasEmpty := oq.tasks.Len() == 0
+	oq.tasks.PushBack(task)
+	// an owner emptied by eviction or dependency filtering can still be in
+	// the heap (index >= 0); pushing it again would duplicate it there.
+	if wasEmpty && oq.index < 0 {
+		// A brand-new owner starts at virtual time zero; one that drained
+		// and is only now reactivating may be sitting on a stale, equally
+		// low value from before its peers accrued virtual time. Either way,
+		// joining below the current minimum would let it monopolize the
+		// scheduler until it catches up, starving everyone else. Joining at
+		// the minimum puts it in the same boat as the owner already due up
+		// next, instead of ahead of it.
+		if min := q.minVirtualTime(); oq.virtualTime < min {
+			oq.virtualTime = min
+		}
+		heap.Push(&q.ownerHeap, oq)
+	}
+}
+
+// minVirtualTime returns the smallest virtual time among owners currently
+// in the scheduling heap, or 0 if none are pending.
+func (q *fifo) minVirtualTime() float64 {
+	if len(q.ownerHeap) == 0 {
+		return 0
+	}
+	return q.ownerHeap[0].virtualTime
 }
 
 // Push pushes a task to the tail of this queue.
 func (q *fifo) Push(_ context.Context, task *model.Task) error {
 	q.Lock()
-	q.pending.PushBack(task)
+	q.pushTask(task)
 	q.Unlock()
 	go q.process()
 	return nil
@@ -76,22 +263,40 @@ func (q *fifo) Push(_ context.Context, task *model.Task) error {
 func (q *fifo) PushAtOnce(_ context.Context, tasks []*model.Task) error {
 	q.Lock()
 	for _, task := range tasks {
-		q.pending.PushBack(task)
+		q.pushTask(task)
 	}
 	q.Unlock()
 	go q.process()
 	return nil
 }
 
-// Poll retrieves and removes a task head of this queue.
-func (q *fifo) Poll(c context.Context, agentID int64, f FilterFn) (*model.Task, error) {
+// SetOwnerWeight sets the fair-share weight used for an owner's virtual-time
+// accounting. Owners default to a weight of 1.
+func (q *fifo) SetOwnerWeight(owner string, w float64) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.weights[owner] = w
+	if oq, ok := q.owners[owner]; ok {
+		oq.weight = w
+	}
+}
+
+// Poll retrieves and removes a task head of this queue. labels is the
+// worker's own label set, matched against a task's RequiredLabels and
+// scored against its PreferredLabels; f remains available as a low-level
+// escape hatch for callers that need arbitrary matching logic.
+func (q *fifo) Poll(c context.Context, agentID int64, labels labelmatch.Labels, f FilterFn) (*model.Task, error) {
 	q.Lock()
 	ctx, stop := context.WithCancelCause(c)
 
+	q.nextSeq++
 	w := &worker{
 		agentID: agentID,
 		channel: make(chan *model.Task, 1),
 		filter:  f,
+		labels:  labels,
+		seq:     q.nextSeq,
 		stop:    stop,
 	}
 	q.workers[w] = struct{}{}
@@ -130,15 +335,22 @@ func (q *fifo) finished(ids []string, exitStatus model.StatusValue, err error) e
 	q.Lock()
 
 	for _, id := range ids {
-		taskEntry, ok := q.running[id]
-		if ok {
-			taskEntry.error = err
+		status, taskErr := exitStatus, err
+		if taskEntry, ok := q.running[id]; ok {
+			if taskEntry.cancelled {
+				// Cancel() raced with (or preceded) the agent's own report;
+				// the task was killed, not failed or succeeded on its own.
+				status, taskErr = model.StatusKilled, nil
+			}
+			taskEntry.error = taskErr
 			close(taskEntry.done)
 			delete(q.running, id)
-		} else {
-			q.removeFromPending(id)
 		}
-		q.updateDepStatusInQueue(id, exitStatus)
+		// a late report can arrive after the task was already requeued for
+		// another attempt, in which case it's also sitting pending; drop
+		// that stale copy so it isn't handed out again.
+		q.removeFromPending(id)
+		q.updateDepStatusInQueue(id, status)
 	}
 
 	q.Unlock()
@@ -150,23 +362,50 @@ func (q *fifo) Evict(c context.Context, id string) error {
 	return q.EvictAtOnce(c, []string{id})
 }
 
+// Cancel marks a running task as cancelled and returns the agent it is
+// currently assigned to, so the caller (the grpc server) can forward the
+// cancellation to that agent over its open stream. It does not itself
+// remove the task from running: that happens once the agent reports back
+// through Done/Error with the cancelled status.
+func (q *fifo) Cancel(_ context.Context, id string) (int64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	state, ok := q.running[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	state.cancelled = true
+	return state.item.AgentID, nil
+}
+
 // EvictAtOnce removes multiple pending tasks from the queue.
 func (q *fifo) EvictAtOnce(_ context.Context, ids []string) error {
 	q.Lock()
 	defer q.Unlock()
 
 	for _, id := range ids {
-		var next *list.Element
-		for e := q.pending.Front(); e != nil; e = next {
-			next = e.Next()
-			task, ok := e.Value.(*model.Task)
-			if ok && task.ID == id {
-				q.pending.Remove(e)
-				return nil
+		found := false
+		for _, oq := range q.owners {
+			var next *list.Element
+			for e := oq.tasks.Front(); e != nil; e = next {
+				next = e.Next()
+				task, ok := e.Value.(*model.Task)
+				if ok && task.ID == id {
+					oq.tasks.Remove(e)
+					found = true
+					break
+				}
 			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return ErrNotFound
 		}
 	}
-	return ErrNotFound
+	return nil
 }
 
 // Wait waits until the item is done executing.
@@ -202,14 +441,25 @@ func (q *fifo) Info(_ context.Context) InfoT {
 	q.Lock()
 	stats := InfoT{}
 	stats.Stats.Workers = len(q.workers)
-	stats.Stats.Pending = q.pending.Len()
 	stats.Stats.WaitingOnDeps = q.waitingOnDeps.Len()
 	stats.Stats.Running = len(q.running)
 
-	for e := q.pending.Front(); e != nil; e = e.Next() {
-		task, _ := e.Value.(*model.Task)
-		stats.Pending = append(stats.Pending, task)
+	owners := make([]OwnerStats, 0, len(q.owners))
+	for owner, oq := range q.owners {
+		stats.Stats.Pending += oq.tasks.Len()
+		owners = append(owners, OwnerStats{
+			Owner:       owner,
+			Pending:     oq.tasks.Len(),
+			Weight:      oq.weight,
+			VirtualTime: oq.virtualTime,
+		})
+		for e := oq.tasks.Front(); e != nil; e = e.Next() {
+			task, _ := e.Value.(*model.Task)
+			stats.Pending = append(stats.Pending, task)
+		}
 	}
+	stats.Owners = owners
+
 	for e := q.waitingOnDeps.Front(); e != nil; e = e.Next() {
 		task, _ := e.Value.(*model.Task)
 		stats.WaitingOnDeps = append(stats.WaitingOnDeps, task)
@@ -263,15 +513,32 @@ func (q *fifo) process() {
 
 	q.resubmitExpiredPipelines()
 	q.filterWaiting()
-	for pending, worker := q.assignToWorker(); pending != nil && worker != nil; pending, worker = q.assignToWorker() {
+	for pending, worker, oq := q.assignToWorker(); pending != nil && worker != nil; pending, worker, oq = q.assignToWorker() {
 		task, _ := pending.Value.(*model.Task)
 		task.AgentID = worker.agentID
 		delete(q.workers, worker)
-		q.pending.Remove(pending)
-		q.running[task.ID] = &entry{
-			item:     task,
-			done:     make(chan bool),
-			deadline: time.Now().Add(q.extension),
+		oq.tasks.Remove(pending)
+		oq.virtualTime += 1 / (oq.weight * priorityFactor(task.Priority))
+		if oq.tasks.Len() > 0 {
+			heap.Push(&q.ownerHeap, oq)
+		} else {
+			// owner has drained; drop its bookkeeping rather than leaking
+			// one owners entry for the rest of the server's lifetime.
+			delete(q.owners, oq.owner)
+		}
+		// a task being reassigned after a requeue already has a live entry
+		// (kept around so Wait() callers stay pointed at the same done
+		// channel); reuse it instead of replacing it, only resetting the
+		// fields that describe this new attempt.
+		if state, ok := q.running[task.ID]; ok {
+			state.retrying = false
+			state.deadline = time.Now().Add(q.extension)
+		} else {
+			q.running[task.ID] = &entry{
+				item:     task,
+				done:     make(chan bool),
+				deadline: time.Now().Add(q.extension),
+			}
 		}
 		worker.channel <- task
 	}
@@ -283,66 +550,139 @@ func (q *fifo) filterWaiting() {
 	for e := q.waitingOnDeps.Front(); e != nil; e = nextWaiting {
 		nextWaiting = e.Next()
 		task, _ := e.Value.(*model.Task)
-		q.pending.PushBack(task)
+		q.pushTask(task)
 	}
 
 	// rebuild waitingDeps
 	q.waitingOnDeps = list.New()
-	var filtered []*list.Element
-	var nextPending *list.Element
-	for e := q.pending.Front(); e != nil; e = nextPending {
-		nextPending = e.Next()
-		task, _ := e.Value.(*model.Task)
-		if q.depsInQueue(task) {
-			log.Debug().Msgf("queue: waiting due to unmet dependencies %v", task.ID)
-			q.waitingOnDeps.PushBack(task)
-			filtered = append(filtered, e)
+	for _, oq := range q.owners {
+		var next *list.Element
+		for e := oq.tasks.Front(); e != nil; e = next {
+			next = e.Next()
+			task, _ := e.Value.(*model.Task)
+			if q.depsInQueue(task) {
+				log.Debug().Msgf("queue: waiting due to unmet dependencies %v", task.ID)
+				q.waitingOnDeps.PushBack(task)
+				oq.tasks.Remove(e)
+			}
 		}
 	}
-
-	// filter waiting tasks
-	for _, f := range filtered {
-		q.pending.Remove(f)
-	}
 }
 
-func (q *fifo) assignToWorker() (*list.Element, *worker) {
-	var next *list.Element
-	for e := q.pending.Front(); e != nil; e = next {
-		next = e.Next()
+// assignToWorker picks the smallest-virtual-time owner whose head task
+// matches some worker's filter, restoring every owner it skips over so
+// their relative order is preserved for the next call.
+func (q *fifo) assignToWorker() (*list.Element, *worker, *ownerQueue) {
+	var skipped []*ownerQueue
+	defer func() {
+		for _, oq := range skipped {
+			heap.Push(&q.ownerHeap, oq)
+		}
+	}()
+
+	now := time.Now()
+	for q.ownerHeap.Len() > 0 {
+		oq := heap.Pop(&q.ownerHeap).(*ownerQueue) //nolint:forcetypeassert
+		e := oq.tasks.Front()
+		if e == nil {
+			// owner has nothing pending (e.g. everything was evicted); drop
+			// it from rotation, and its bookkeeping along with it, until it
+			// receives a new task.
+			delete(q.owners, oq.owner)
+			continue
+		}
 		task, _ := e.Value.(*model.Task)
+		if task.NotBefore.After(now) {
+			// task is serving out its requeue backoff; don't let it block
+			// the owner's turn, but don't drop the owner either.
+			skipped = append(skipped, oq)
+			continue
+		}
 		log.Debug().Msgf("queue: trying to assign task: %v with deps %v", task.ID, task.Dependencies)
 
-		for w := range q.workers {
-			if w.filter(task) {
-				log.Debug().Msgf("queue: assigned task: %v with deps %v", task.ID, task.Dependencies)
-				return e, w
-			}
+		if best := q.bestWorker(task); best != nil {
+			log.Debug().Msgf("queue: assigned task: %v with deps %v", task.ID, task.Dependencies)
+			return e, best, oq
 		}
+		skipped = append(skipped, oq)
 	}
 
-	return nil, nil
+	return nil, nil, nil
+}
+
+// bestWorker returns the eligible worker that scores highest against
+// task's preferred labels, breaking ties by who registered first. A worker
+// is eligible if it passes the task's FilterFn and satisfies its
+// RequiredLabels; nil is returned if none do.
+func (q *fifo) bestWorker(task *model.Task) *worker {
+	var best *worker
+	var bestScore float64
+
+	for w := range q.workers {
+		if !w.filter(task) {
+			continue
+		}
+		if !labelmatch.Matches(task.RequiredLabels, w.labels) {
+			continue
+		}
+		score := labelmatch.Score(task.PreferredLabels, w.labels)
+		if best == nil || score > bestScore || (score == bestScore && w.seq < best.seq) {
+			best = w
+			bestScore = score
+		}
+	}
+
+	return best
 }
 
 func (q *fifo) resubmitExpiredPipelines() {
+	now := time.Now()
 	for id, state := range q.running {
-		if time.Now().After(state.deadline) {
-			q.pending.PushFront(state.item)
-			delete(q.running, id)
+		if state.retrying {
+			// already requeued and waiting to be handed to a worker again;
+			// it isn't actually running, so it can't have expired.
+			continue
+		}
+		if !now.After(state.deadline) {
+			continue
+		}
+
+		task := state.item
+		task.Attempts++
+		maxAttempts := task.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultMaxAttempts
+		}
+
+		if task.Attempts >= maxAttempts {
+			log.Warn().Msgf("queue: task %s exceeded %d attempts, failing as deadline exceeded", id, maxAttempts)
+			state.error = fmt.Errorf("deadline exceeded after %d attempts", task.Attempts)
 			close(state.done)
+			delete(q.running, id)
+			continue
 		}
+
+		log.Debug().Msgf("queue: task %s expired, requeuing (attempt %d/%d)", id, task.Attempts, maxAttempts)
+		task.NotBefore = now.Add(requeueBackoff(task.Attempts))
+		// keep the entry (and its done channel) alive under the same ID
+		// rather than deleting it: a caller already blocked in Wait() holds
+		// a pointer to this exact entry, and it needs to stay the one that
+		// eventually gets closed with the task's real outcome, not be
+		// orphaned by a fresh entry created when the task is reassigned.
+		state.retrying = true
+		q.pushTask(task)
 	}
 }
 
 func (q *fifo) depsInQueue(task *model.Task) bool {
-	var next *list.Element
-	for e := q.pending.Front(); e != nil; e = next {
-		next = e.Next()
-		possibleDep, ok := e.Value.(*model.Task)
-		log.Debug().Msgf("queue: pending right now: %v", possibleDep.ID)
-		for _, dep := range task.Dependencies {
-			if ok && possibleDep.ID == dep {
-				return true
+	for _, oq := range q.owners {
+		for e := oq.tasks.Front(); e != nil; e = e.Next() {
+			possibleDep, ok := e.Value.(*model.Task)
+			log.Debug().Msgf("queue: pending right now: %v", possibleDep.ID)
+			for _, dep := range task.Dependencies {
+				if ok && possibleDep.ID == dep {
+					return true
+				}
 			}
 		}
 	}
@@ -358,13 +698,13 @@ func (q *fifo) depsInQueue(task *model.Task) bool {
 }
 
 func (q *fifo) updateDepStatusInQueue(taskID string, status model.StatusValue) {
-	var next *list.Element
-	for e := q.pending.Front(); e != nil; e = next {
-		next = e.Next()
-		pending, ok := e.Value.(*model.Task)
-		for _, dep := range pending.Dependencies {
-			if ok && taskID == dep {
-				pending.DepStatus[dep] = status
+	for _, oq := range q.owners {
+		for e := oq.tasks.Front(); e != nil; e = e.Next() {
+			pending, ok := e.Value.(*model.Task)
+			for _, dep := range pending.Dependencies {
+				if ok && taskID == dep {
+					pending.DepStatus[dep] = status
+				}
 			}
 		}
 	}
@@ -377,6 +717,7 @@ func (q *fifo) updateDepStatusInQueue(taskID string, status model.StatusValue) {
 		}
 	}
 
+	var next *list.Element
 	for e := q.waitingOnDeps.Front(); e != nil; e = next {
 		next = e.Next()
 		waiting, ok := e.Value.(*model.Task)
@@ -390,14 +731,16 @@ func (q *fifo) updateDepStatusInQueue(taskID string, status model.StatusValue) {
 
 func (q *fifo) removeFromPending(taskID string) {
 	log.Debug().Msgf("queue: trying to remove %s", taskID)
-	var next *list.Element
-	for e := q.pending.Front(); e != nil; e = next {
-		next = e.Next()
-		task, _ := e.Value.(*model.Task)
-		if task.ID == taskID {
-			log.Debug().Msgf("queue: %s is removed from pending", taskID)
-			q.pending.Remove(e)
-			return
+	for _, oq := range q.owners {
+		var next *list.Element
+		for e := oq.tasks.Front(); e != nil; e = next {
+			next = e.Next()
+			task, _ := e.Value.(*model.Task)
+			if task.ID == taskID {
+				log.Debug().Msgf("queue: %s is removed from pending", taskID)
+				oq.tasks.Remove(e)
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,65 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// TestFifoCancelOverridesReportedStatus asserts that once Cancel has been
+// called for a running task, whatever the agent later reports through
+// Done/Error can't make it look like a normal success or failure: it is
+// always recorded as killed, as observed through a dependent task's
+// DepStatus.
+func TestFifoCancelOverridesReportedStatus(t *testing.T) {
+	q := newFifo()
+
+	dependent := &model.Task{ID: "dependent", Dependencies: []string{"cancel-me"}, DepStatus: map[string]model.StatusValue{}}
+	if err := q.PushAtOnce(context.Background(), []*model.Task{
+		{ID: "cancel-me"},
+		dependent,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Poll(context.Background(), 1, labelmatch.Labels{}, func(*model.Task) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	agentID, err := q.Cancel(context.Background(), "cancel-me")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), agentID)
+
+	// the agent raced the cancellation and reported its own failure; the
+	// cancellation should win over whatever it said.
+	assert.NoError(t, q.Error(context.Background(), "cancel-me", errors.New("build step failed")))
+
+	assert.Equal(t, model.StatusKilled, dependent.DepStatus["cancel-me"])
+}
+
+// TestFifoCancelNotRunningIsNotFound asserts Cancel reports ErrNotFound for
+// a task that isn't currently running (already finished, or never existed).
+func TestFifoCancelNotRunningIsNotFound(t *testing.T) {
+	q := newFifo()
+	_, err := q.Cancel(context.Background(), "no-such-task")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// TestFifoFairShareWeighting asserts that weighting an owner 3x another
+// still hands out every task of both owners, and that the weighted owner
+// comes out ahead early in the run.
+func TestFifoFairShareWeighting(t *testing.T) {
+	q := newFifo()
+	q.SetOwnerWeight("ownerA", 3)
+
+	var tasks []*model.Task
+	for i := 0; i < 20; i++ {
+		tasks = append(tasks,
+			&model.Task{ID: fmt.Sprintf("a-%d", i), OwnerKey: "ownerA"},
+			&model.Task{ID: fmt.Sprintf("b-%d", i), OwnerKey: "ownerB"},
+		)
+	}
+	if err := q.PushAtOnce(context.Background(), tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	var countA, countB int
+	for i := 0; i < len(tasks); i++ {
+		task, err := q.Poll(context.Background(), 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch task.OwnerKey {
+		case "ownerA":
+			countA++
+		case "ownerB":
+			countB++
+		}
+	}
+
+	assert.Equal(t, 20, countA)
+	assert.Equal(t, 20, countB)
+
+	// confirm the weighting actually changed the order things were handed
+	// out in, not just the eventual totals: ownerA (weight 3) accrues only
+	// 1/3 virtual time per task to ownerB's 1, so it gets 3 of the first 4.
+	q2 := newFifo()
+	q2.SetOwnerWeight("ownerA", 3)
+	tasks = nil
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks,
+			&model.Task{ID: fmt.Sprintf("a2-%d", i), OwnerKey: "ownerA"},
+			&model.Task{ID: fmt.Sprintf("b2-%d", i), OwnerKey: "ownerB"},
+		)
+	}
+	if err := q2.PushAtOnce(context.Background(), tasks); err != nil {
+		t.Fatal(err)
+	}
+	aSoFar, bSoFar := 0, 0
+	for i := 0; i < 4; i++ {
+		task, err := q2.Poll(context.Background(), 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.OwnerKey == "ownerA" {
+			aSoFar++
+		} else {
+			bSoFar++
+		}
+	}
+	assert.Greater(t, aSoFar, bSoFar, "weight-3 owner should lead after only 4 of 20 assignments")
+}
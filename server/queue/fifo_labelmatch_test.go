@@ -0,0 +1,69 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+func alwaysMatch(*model.Task) bool { return true }
+
+func TestFifoBestWorkerPrefersHigherScore(t *testing.T) {
+	q := newFifo()
+	task := &model.Task{
+		ID: "t1",
+		PreferredLabels: []model.Preferred{
+			{Key: "gpu", Value: "true", Weight: 1},
+			{Key: "arch", Value: "arm64", Weight: 5},
+		},
+	}
+
+	low := &worker{seq: 1, filter: alwaysMatch, labels: labelmatch.Labels{"gpu": "true"}}
+	high := &worker{seq: 2, filter: alwaysMatch, labels: labelmatch.Labels{"arch": "arm64"}}
+	q.workers[low] = struct{}{}
+	q.workers[high] = struct{}{}
+
+	assert.Same(t, high, q.bestWorker(task))
+}
+
+func TestFifoBestWorkerTieBreaksByRegistrationOrder(t *testing.T) {
+	q := newFifo()
+	task := &model.Task{
+		ID:              "t1",
+		PreferredLabels: []model.Preferred{{Key: "gpu", Value: "true", Weight: 1}},
+	}
+
+	first := &worker{seq: 1, filter: alwaysMatch, labels: labelmatch.Labels{"gpu": "true"}}
+	second := &worker{seq: 2, filter: alwaysMatch, labels: labelmatch.Labels{"gpu": "true"}}
+	q.workers[second] = struct{}{}
+	q.workers[first] = struct{}{}
+
+	assert.Same(t, first, q.bestWorker(task), "equal-scoring workers should tie-break to whichever registered first")
+}
+
+func TestFifoBestWorkerExcludesMissingRequiredLabel(t *testing.T) {
+	q := newFifo()
+	task := &model.Task{ID: "t1", RequiredLabels: map[string]string{"arch": "arm64"}}
+
+	mismatched := &worker{seq: 1, filter: alwaysMatch, labels: labelmatch.Labels{"arch": "amd64"}}
+	q.workers[mismatched] = struct{}{}
+
+	assert.Nil(t, q.bestWorker(task))
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// TestFifoRequeueOnExpiry asserts that a task whose deadline passes without
+// a Done/Error is requeued with a backoff instead of being lost.
+func TestFifoRequeueOnExpiry(t *testing.T) {
+	q := newFifo()
+	q.extension = time.Millisecond
+
+	task := &model.Task{ID: "requeue-me", MaxAttempts: 3}
+	if err := q.Push(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := q.Poll(context.Background(), 1, labelmatch.Labels{}, func(*model.Task) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "requeue-me", got.ID)
+
+	time.Sleep(2 * time.Millisecond)
+	q.Lock()
+	q.resubmitExpiredPipelines()
+	q.Unlock()
+
+	assert.Equal(t, 1, got.Attempts)
+	assert.True(t, got.NotBefore.After(time.Now()), "requeued task should be held back by its backoff")
+}
+
+// TestFifoFailsAfterMaxAttempts asserts that a task stops being requeued
+// once it has exhausted MaxAttempts, failing outright instead.
+func TestFifoFailsAfterMaxAttempts(t *testing.T) {
+	q := newFifo()
+	task := &model.Task{ID: "give-up", MaxAttempts: 2}
+
+	var last *entry
+	for attempt := 0; attempt < task.MaxAttempts; attempt++ {
+		last = &entry{item: task, done: make(chan bool), deadline: time.Now().Add(-time.Millisecond)}
+		q.Lock()
+		q.running[task.ID] = last
+		q.resubmitExpiredPipelines()
+		q.Unlock()
+	}
+
+	assert.Equal(t, task.MaxAttempts, task.Attempts)
+
+	select {
+	case <-last.done:
+		assert.Error(t, last.error)
+	default:
+		t.Fatal("expected the final attempt to close done with an error instead of requeuing again")
+	}
+}
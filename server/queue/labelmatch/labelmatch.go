@@ -0,0 +1,49 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package labelmatch implements Kubernetes-style node-affinity matching
+// between a task's label requirements/preferences and a worker's label
+// set, so the queue can express things like "require arch=arm64, prefer
+// gpu=true".
+package labelmatch
+
+import "go.woodpecker-ci.org/woodpecker/v2/server/model"
+
+// Labels is a worker's (or a task's matched-against) label set, e.g.
+// {"arch": "arm64", "gpu": "true"}.
+type Labels map[string]string
+
+// Matches reports whether worker satisfies every required label. An empty
+// or nil required set always matches.
+func Matches(required Labels, worker Labels) bool {
+	for k, v := range required {
+		if worker[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Score sums the weight of every preferred label worker satisfies. Workers
+// that match more/heavier preferences score higher; a worker matching none
+// of them still scores 0, not a disqualification.
+func Score(preferred []model.Preferred, worker Labels) float64 {
+	var score float64
+	for _, p := range preferred {
+		if worker[p.Key] == p.Value {
+			score += p.Weight
+		}
+	}
+	return score
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Woodpecker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"errors"
+
+	"go.woodpecker-ci.org/woodpecker/v2/server/model"
+	"go.woodpecker-ci.org/woodpecker/v2/server/queue/labelmatch"
+)
+
+// ErrNotFound is returned when an operation references a task ID the queue
+// doesn't know about (or no longer does).
+var ErrNotFound = errors.New("queue: task not found")
+
+// FilterFn reports whether a worker is able to run task, as a low-level
+// escape hatch underneath the label matcher.
+type FilterFn func(task *model.Task) bool
+
+// Queue defines a task queue for scheduling tasks among agents.
+type Queue interface {
+	// Push pushes a task to the tail of this queue.
+	Push(c context.Context, task *model.Task) error
+	// PushAtOnce pushes multiple tasks to the tail of this queue.
+	PushAtOnce(c context.Context, tasks []*model.Task) error
+	// Poll retrieves and removes the head of this queue for a worker
+	// advertising labels, blocking until a task is available or ctx is done.
+	Poll(c context.Context, agentID int64, labels labelmatch.Labels, f FilterFn) (*model.Task, error)
+	// Extend extends the task execution deadline.
+	Extend(c context.Context, id string) error
+	// Done signals the task is complete.
+	Done(c context.Context, id string, exitStatus model.StatusValue) error
+	// Error signals the task is done with an error.
+	Error(c context.Context, id string, err error) error
+	// ErrorAtOnce signals multiple tasks are done with an error.
+	ErrorAtOnce(c context.Context, id []string, err error) error
+	// Evict removes a pending task from the queue.
+	Evict(c context.Context, id string) error
+	// EvictAtOnce removes multiple pending tasks from the queue.
+	EvictAtOnce(c context.Context, id []string) error
+	// Cancel marks a running task as cancelled, returning the agent it is
+	// assigned to so the caller can forward the cancellation.
+	Cancel(c context.Context, id string) (int64, error)
+	// Wait waits until the task is complete.
+	Wait(c context.Context, id string) error
+	// SetOwnerWeight sets the fair-share weight used for an owner.
+	SetOwnerWeight(owner string, weight float64)
+	// Info returns internal queue information.
+	Info(c context.Context) InfoT
+	// Pause stops the queue from handing out new work items in Poll.
+	Pause()
+	// Resume starts the queue again.
+	Resume()
+	// KickAgentWorkers kicks all workers for a given agent.
+	KickAgentWorkers(agentID int64)
+}
+
+// Stats holds simple queue depth counters.
+type Stats struct {
+	Workers       int
+	Pending       int
+	WaitingOnDeps int
+	Running       int
+}
+
+// InfoT describes the queue's internal state, as surfaced by Info().
+type InfoT struct {
+	Pending       []*model.Task
+	WaitingOnDeps []*model.Task
+	Running       []*model.Task
+	Stats         Stats
+	Paused        bool
+	// Owners reports per-owner fair-share bookkeeping; only populated by
+	// backends that implement weighted fair scheduling.
+	Owners []OwnerStats
+}